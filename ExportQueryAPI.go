@@ -9,7 +9,7 @@ import (
 	"io"
 	"net/http"
 	"os"
-	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -18,23 +18,32 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/emrserverless"
+	"github.com/golang-jwt/jwt"
 	"github.com/google/uuid"
 	_ "github.com/lib/pq"
 	log "github.com/sirupsen/logrus"
-	"github.com/golang-jwt/jwt"
+
+	"ExportQueryAPI/internal/audit"
+	"ExportQueryAPI/internal/auth"
+	"ExportQueryAPI/internal/costestimate"
+	"ExportQueryAPI/internal/destination"
+	"ExportQueryAPI/internal/idempotency"
+	"ExportQueryAPI/internal/ratelimit"
 )
 
 type RequestBody struct {
 	Query             string `json:"query"`
 	Destination       string `json:"destination"`
 	CrossBucketRegion string `json:"region"`
+	CallbackUrl       string `json:"callbackUrl,omitempty"`
 }
 
 type SuccessResponse struct {
-	Id        string `json:"id"`
-	JobId     string `json:"jobId"`
-	RequestId string `json:"requestId"`
-	JobStatus string `json:"jobStatus"`
+	Id            string  `json:"id"`
+	JobId         string  `json:"jobId"`
+	RequestId     string  `json:"requestId"`
+	JobStatus     string  `json:"jobStatus"`
+	EstimatedCost float64 `json:"estimatedCost,omitempty"`
 }
 
 type FailureResponse struct {
@@ -62,8 +71,12 @@ var vaultUrl string
 var service *emrserverless.EMRServerless
 var secrets *string
 var validVaultIds []string
-var re *regexp.Regexp
 var source string
+var skipJwtVerify bool
+var jwtVerifier *auth.Verifier
+var rateLimiter *ratelimit.Limiter
+var costEstimator *costestimate.Estimator
+var jwksRefreshStop = make(chan struct{})
 
 func init() {
 	log.SetFormatter(&log.JSONFormatter{})
@@ -76,8 +89,6 @@ func init() {
 	secrets = aws.String(os.Getenv("SECRETS"))
 	region = aws.String(os.Getenv("REGION"))
 
-	re = regexp.MustCompile(`^s3://([^/]+)/(.*?([^/]+)/?)$`)
-
 	host := os.Getenv("DB_HOST")
 	port := os.Getenv("DB_PORT")
 	user := os.Getenv("DB_USER")
@@ -103,9 +114,61 @@ func init() {
 
 	validVaultIds = strings.Split(os.Getenv("VALID_VAULT_IDS"), ",")
 
+	skipJwtVerify = strings.EqualFold(os.Getenv("SKIP_JWT_VERIFY"), "true")
+	jwtVerifier = auth.NewVerifier(os.Getenv("JWKS_URL"), os.Getenv("JWT_ISSUER"), os.Getenv("JWT_AUDIENCE"), 15*time.Minute)
+	jwtVerifier.StartBackgroundRefresh(15*time.Minute, jwksRefreshStop)
+
+	rateLimiter = ratelimit.New(db, ratelimit.Thresholds{
+		MaxJobsPerMinute:        envIntOrDefault("MAX_JOBS_PER_MINUTE", 10),
+		MaxConcurrentJobsPerJTI: envIntOrDefault("MAX_CONCURRENT_JOBS_PER_JTI", 3),
+		MaxConcurrentJobsGlobal: envIntOrDefault("MAX_CONCURRENT_JOBS_GLOBAL", 50),
+	})
+
+	replicaConnection := fmt.Sprintf(
+		"host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
+		os.Getenv("REPLICA_DB_HOST"),
+		os.Getenv("REPLICA_DB_PORT"),
+		os.Getenv("REPLICA_DB_USER"),
+		os.Getenv("REPLICA_DB_PASSWORD"),
+		os.Getenv("REPLICA_DB_NAME"),
+	)
+	replicaDb, _ := sql.Open("postgres", replicaConnection)
+
+	costEstimator = costestimate.New(replicaDb, costestimate.Thresholds{
+		MaxPlanCost: envFloatOrDefault("MAX_PLAN_COST", 100000),
+		MaxPlanRows: envFloatOrDefault("MAX_PLAN_ROWS", 10000000),
+	}, 10*time.Minute, time.Duration(envIntOrDefault("COST_ESTIMATE_STATEMENT_TIMEOUT_MS", 5000))*time.Millisecond)
+
 	source = "ExportQueryAPI"
 }
 
+func envIntOrDefault(key string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+func envFloatOrDefault(key string, fallback float64) float64 {
+	value, err := strconv.ParseFloat(os.Getenv(key), 64)
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+// markReservationFailed transitions the PENDING row rateLimiter.Reserve
+// inserted for id to FAILED, so a later failure doesn't leave it occupying
+// a concurrency slot or permanently answering Idempotency-Key replays with
+// a job that never ran. It's best-effort: failures are logged, not returned,
+// since callers invoke it while already handling a different error.
+func markReservationFailed(id string) {
+	if err := rateLimiter.MarkFailed(id); err != nil {
+		logger.Error(fmt.Sprintf("Failed to mark reservation FAILED for id: %v with error: %v", id, err.Error()))
+	}
+}
+
 func main() {
 	lambda.Start(HandleRequest)
 }
@@ -115,7 +178,7 @@ func HandleRequest(request events.APIGatewayProxyRequest) (events.APIGatewayProx
 
 	logger = log.WithFields(log.Fields{
 		"queryId": id,
-		"source": source,
+		"source":  source,
 	})
 
 	apiResponse := events.APIGatewayProxyResponse{}
@@ -136,10 +199,23 @@ func HandleRequest(request events.APIGatewayProxyRequest) (events.APIGatewayProx
 	vaultId := request.PathParameters["vaultID"]
 	token := request.Headers["Authorization"]
 
-	if !re.Match([]byte(body.Destination)) {
+	dest, err := destination.New(body.Destination, body.CrossBucketRegion)
+	if err != nil {
+		responseBody, _ := json.Marshal(FailureResponse{
+			Id:      id,
+			Message: fmt.Sprintf("Invalid destination path: %v", err.Error()),
+		})
+
+		apiResponse.Body = string(responseBody)
+		apiResponse.StatusCode = http.StatusBadRequest
+
+		return apiResponse, nil
+	}
+
+	if err := dest.Validate(); err != nil {
 		responseBody, _ := json.Marshal(FailureResponse{
 			Id:      id,
-			Message: "Invalid s3 destination path.",
+			Message: fmt.Sprintf("Invalid destination configuration: %v", err.Error()),
 		})
 
 		apiResponse.Body = string(responseBody)
@@ -165,11 +241,11 @@ func HandleRequest(request events.APIGatewayProxyRequest) (events.APIGatewayProx
 	if err != nil {
 		responseBody, _ := json.Marshal(FailureResponse{
 			Id:      id,
-			Message: fmt.Sprintf("Failed to extract jti with error: %v", err.Error()),
+			Message: fmt.Sprintf("Failed to verify token with error: %v", err.Error()),
 		})
 
 		apiResponse.Body = string(responseBody)
-		apiResponse.StatusCode = http.StatusForbidden
+		apiResponse.StatusCode = http.StatusUnauthorized
 
 		return apiResponse, nil
 	}
@@ -217,19 +293,113 @@ func HandleRequest(request events.APIGatewayProxyRequest) (events.APIGatewayProx
 		return apiResponse, nil
 	}
 
+	redactedQuery, literalHashes := audit.Redact(body.Query)
+
 	logger = logger.WithFields(log.Fields{
-		"skyflowRequestId": authResponse.RequestId,
-		"query": body.Query,
+		"skyflowRequestId":  authResponse.RequestId,
+		"query":             redactedQuery,
 		"destinationBucket": body.Destination,
-		"region": body.CrossBucketRegion,
+		"region":            body.CrossBucketRegion,
 	})
 
 	logger.Info("Sucessfully Authorized")
 
-	logger.Info(fmt.Sprintf("Triggering Spark job with args, query: %v, destination: %v", body.Query, body.Destination))
+	idempotencyHash := ""
+	if idempotencyKey := request.Headers["Idempotency-Key"]; idempotencyKey != "" {
+		idempotencyHash = idempotency.Hash(idempotencyKey, jti, vaultId, body.Query, body.Destination)
+	}
+
+	reservation, err := rateLimiter.Reserve(id, jti, clientIpAddress, idempotencyHash)
+	if err != nil {
+		responseBody, _ := json.Marshal(FailureResponse{
+			Id:      id,
+			Message: fmt.Sprintf("Failed to evaluate rate limits with error: %v", err.Error()),
+		})
+
+		apiResponse.Body = string(responseBody)
+		apiResponse.StatusCode = http.StatusInternalServerError
+
+		return apiResponse, nil
+	}
+
+	if reservation.Replayed {
+		logger.Info("Replaying stored response for Idempotency-Key")
+
+		responseBody, _ := json.Marshal(SuccessResponse{
+			Id:        reservation.ExistingId,
+			JobId:     reservation.ExistingJobId,
+			JobStatus: reservation.ExistingJobStatus,
+			RequestId: reservation.ExistingRequestId,
+		})
+
+		apiResponse.Headers = map[string]string{
+			"X-Idempotent-Replay": "true",
+		}
+		apiResponse.Body = string(responseBody)
+		apiResponse.StatusCode = http.StatusOK
+
+		return apiResponse, nil
+	}
+
+	if !reservation.Allowed {
+		logger.WithFields(log.Fields{
+			"limitTriggered": reservation.Reason,
+		}).Info("Rejected request due to rate limit")
 
-	jobId, err := TriggerEMRJob(body.Query, id)
+		responseBody, _ := json.Marshal(FailureResponse{
+			Id:      id,
+			Message: fmt.Sprintf("Rate limit exceeded: %v", reservation.Reason),
+		})
+
+		apiResponse.Headers = map[string]string{
+			"Retry-After": fmt.Sprintf("%v", int(reservation.RetryAfter.Seconds())),
+		}
+		apiResponse.Body = string(responseBody)
+		apiResponse.StatusCode = http.StatusTooManyRequests
+
+		return apiResponse, nil
+	}
+
+	estimate, err := costEstimator.Estimate(body.Query)
+	if err != nil {
+		markReservationFailed(id)
+
+		responseBody, _ := json.Marshal(FailureResponse{
+			Id:      id,
+			Message: fmt.Sprintf("Failed to estimate query cost with error: %v", err.Error()),
+		})
+
+		apiResponse.Body = string(responseBody)
+		apiResponse.StatusCode = http.StatusInternalServerError
+
+		return apiResponse, nil
+	}
+
+	if err := costEstimator.CheckThresholds(estimate); err != nil {
+		markReservationFailed(id)
+
+		logger.WithFields(log.Fields{
+			"estimatedCost": estimate.TotalCost,
+			"estimatedRows": estimate.PlanRows,
+		}).Info("Rejected request due to query cost pre-flight")
+
+		responseBody, _ := json.Marshal(FailureResponse{
+			Id:      id,
+			Message: err.Error(),
+		})
+
+		apiResponse.Body = string(responseBody)
+		apiResponse.StatusCode = http.StatusBadRequest
+
+		return apiResponse, nil
+	}
+
+	logger.Info(fmt.Sprintf("Triggering Spark job with args, query: %v, destination: %v", redactedQuery, body.Destination))
+
+	jobId, err := TriggerEMRJob(body.Query, id, dest.Descriptor())
 	if err != nil {
+		markReservationFailed(id)
+
 		responseBody, _ := json.Marshal(FailureResponse{
 			Id:      id,
 			Message: fmt.Sprintf("Failed to trigger Spark job with error: %v\n", err.Error()),
@@ -243,8 +413,29 @@ func HandleRequest(request events.APIGatewayProxyRequest) (events.APIGatewayProx
 
 	jobStatus := "INITIATED"
 
-	logJobError := LogJob(id, jobId, jobStatus, authResponse.RequestId, body.Query, body.Destination, body.CrossBucketRegion, jti, clientIpAddress)
+	tx, err := db.Begin()
+	if err != nil {
+		markReservationFailed(id)
+
+		responseBody, _ := json.Marshal(FailureResponse{
+			Id:      id,
+			Message: fmt.Sprintf("Failed to log job with error: %v\n", err.Error()),
+		})
+
+		apiResponse.Body = string(responseBody)
+		apiResponse.StatusCode = http.StatusInternalServerError
+
+		return apiResponse, nil
+	}
+	defer tx.Rollback()
+
+	logJobError := LogJob(tx, id, jobId, jobStatus, authResponse.RequestId, redactedQuery, body.Destination, body.CrossBucketRegion, jti, clientIpAddress, body.CallbackUrl, estimate.TotalCost)
+	if logJobError == nil {
+		logJobError = tx.Commit()
+	}
 	if logJobError != nil {
+		markReservationFailed(id)
+
 		responseBody, _ := json.Marshal(FailureResponse{
 			Id:      id,
 			Message: fmt.Sprintf("Failed to log job with error: %v\n", logJobError.Error()),
@@ -256,11 +447,39 @@ func HandleRequest(request events.APIGatewayProxyRequest) (events.APIGatewayProx
 		return apiResponse, nil
 	}
 
+	// The emr_job_details row above is the source of truth for this job's
+	// status, and by this point the EMR job is already running. Audit
+	// logging runs as its own best-effort transaction so a failure here
+	// (e.g. KMS throttling) can't make an already-billing job vanish from
+	// emr_job_details.
+	auditTx, auditErr := db.Begin()
+	if auditErr == nil {
+		auditErr = audit.Write(auditTx, audit.Record{
+			QueryId:       id,
+			Jti:           jti,
+			ClientIp:      clientIpAddress,
+			VaultId:       vaultId,
+			RedactedQuery: redactedQuery,
+			LiteralHashes: literalHashes,
+			Timestamp:     time.Now(),
+			Action:        "export_query",
+		}, body.Query)
+	}
+	if auditErr == nil {
+		auditErr = auditTx.Commit()
+	} else if auditTx != nil {
+		auditTx.Rollback()
+	}
+	if auditErr != nil {
+		logger.Error(fmt.Sprintf("Failed to write audit log for jobId: %v with error: %v", jobId, auditErr.Error()))
+	}
+
 	responseBody, _ := json.Marshal(SuccessResponse{
-		Id:        id,
-		JobId:     jobId,
-		JobStatus: jobStatus,
-		RequestId: authResponse.RequestId,
+		Id:            id,
+		JobId:         jobId,
+		JobStatus:     jobStatus,
+		RequestId:     authResponse.RequestId,
+		EstimatedCost: estimate.TotalCost,
 	})
 
 	apiResponse.Body = string(responseBody)
@@ -283,18 +502,34 @@ func ValidateAuthScheme(token string) bool {
 func ExtractJTI(authToken string) (string, error) {
 	logger.Info("Initiating ExtractJTI")
 
-	tokenString := strings.Split(authToken, " ")[1]
+	parts := strings.SplitN(authToken, " ", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		logger.Error("Authorization header is missing a token")
+		return "", fmt.Errorf("Authorization header is missing a token")
+	}
+	tokenString := parts[1]
+
+	if skipJwtVerify {
+		logger.Info("SKIP_JWT_VERIFY is set, skipping signature verification")
+		token, _, err := new(jwt.Parser).ParseUnverified(tokenString, jwt.MapClaims{})
+		if err != nil {
+			logger.Error(fmt.Sprintf("Got error: %v in token parsing", err.Error()))
+			return "", err
+		}
+		claims := token.Claims.(jwt.MapClaims)
+		jti, _ := claims["jti"].(string)
+		return jti, nil
+	}
 
-	logger.Info("Initiating token parsing")
-	token, _, err := new(jwt.Parser).ParseUnverified(tokenString, jwt.MapClaims{})
+	logger.Info("Initiating token verification against JWKS")
+	claims, err := jwtVerifier.Verify(tokenString)
 	if err != nil {
-		logger.Error(fmt.Sprintf("Got error: %v in token parsing", err.Error()))
+		logger.Error(fmt.Sprintf("Got error: %v verifying token", err.Error()))
 		return "", err
 	}
 
-	logger.Info("Successfully parsed token")
-	claims := token.Claims.(jwt.MapClaims)
-	jti := claims["jti"].(string)
+	logger.Info("Successfully verified token")
+	jti, _ := claims["jti"].(string)
 
 	return jti, nil
 }
@@ -360,8 +595,30 @@ func SkyflowAuthorization(token string, query string, vaultId string, id string)
 	return authResponse
 }
 
-func TriggerEMRJob(query string, id string) (string, error) {
-	entryPointArguments := []*string{aws.String(query), aws.String(id), secrets, region}
+// TriggerEMRJob submits the Spark job for query, passing descriptor's
+// normalized fields as positional entryPointArguments so the Spark side can
+// pick the right connector and configure it correctly:
+//
+//	[query, id, secrets, region, backend, bucket, path, destRegion, endpoint, pathStyle]
+//
+// destRegion is the destination's own region (which may differ from the
+// deployment's default region for a cross-bucket-region S3 export), and
+// pathStyle ("true"/"false") tells the S3A connector whether to address
+// the bucket as a path (required for MinIO/Ceph-style S3-compatible
+// endpoints) instead of virtual-hosted-style.
+func TriggerEMRJob(query string, id string, descriptor destination.Descriptor) (string, error) {
+	entryPointArguments := []*string{
+		aws.String(query),
+		aws.String(id),
+		secrets,
+		region,
+		aws.String(string(descriptor.Backend)),
+		aws.String(descriptor.Bucket),
+		aws.String(descriptor.Path),
+		aws.String(descriptor.Region),
+		aws.String(descriptor.Endpoint),
+		aws.String(strconv.FormatBool(descriptor.PathStyle)),
+	}
 
 	logger.Info("Initiating TriggerEMRJob")
 
@@ -398,17 +655,19 @@ func TriggerEMRJob(query string, id string) (string, error) {
 	return *jobRunOutput.JobRunId, nil
 }
 
-func LogJob(id string, jobId string, jobStatus string, requestId string, query string, destination string, cross_bucket_region string, jti string, clientIp string) error {
+// LogJob fills in the rest of the emr_job_details row that rateLimiter.Reserve
+// already inserted as a PENDING placeholder for id.
+func LogJob(tx *sql.Tx, id string, jobId string, jobStatus string, requestId string, query string, destination string, cross_bucket_region string, jti string, clientIp string, callbackUrl string, estimatedCost float64) error {
 
 	logger.Info("Initiating LogJob")
 
-	statement := `INSERT INTO "emr_job_details"("id", "jobid", "jobstatus", "requestid", "query", "destination", "createdat", "cross_bucket_region", "jti", "client_ip") VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`
+	statement := `UPDATE "emr_job_details" SET "jobid" = $2, "jobstatus" = $3, "requestid" = $4, "query" = $5, "destination" = $6, "cross_bucket_region" = $7, "callbackurl" = $8, "estimated_cost" = $9 WHERE "id" = $1`
 
-	logger.Info(fmt.Sprintf("Inserting record for jobId: %v & requestId:%v", jobId, requestId))
-	_, err := db.Exec(statement, id, jobId, jobStatus, requestId, query, destination, time.Now(), cross_bucket_region, jti, clientIp)
+	logger.Info(fmt.Sprintf("Updating record for jobId: %v & requestId:%v", jobId, requestId))
+	_, err := tx.Exec(statement, id, jobId, jobStatus, requestId, query, destination, cross_bucket_region, sql.NullString{String: callbackUrl, Valid: callbackUrl != ""}, estimatedCost)
 
 	if err != nil {
-		logger.Error(fmt.Sprintf("Failed to insert record for jobId: %v with error: %v", jobId, err.Error()))
+		logger.Error(fmt.Sprintf("Failed to update record for jobId: %v with error: %v", jobId, err.Error()))
 		return err
 	}
 
@@ -0,0 +1,84 @@
+// Command reconciler is a second Lambda, triggered on an EventBridge
+// schedule, that reconciles in-flight EMR Serverless job runs started by
+// the ExportQueryAPI Lambda and notifies any registered callback URLs.
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/emrserverless"
+	_ "github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+
+	"ExportQueryAPI/internal/idempotency"
+	"ExportQueryAPI/internal/reconciler"
+)
+
+var recon *reconciler.Reconciler
+var idempotencyDb *sql.DB
+
+const idempotencyKeyTTL = 24 * time.Hour
+
+func init() {
+	log.SetFormatter(&log.JSONFormatter{})
+
+	applicationId := aws.String(os.Getenv("APPLICATION_ID"))
+	region := aws.String(os.Getenv("REGION"))
+	signingSecret := os.Getenv("CALLBACK_SIGNING_SECRET")
+
+	host := os.Getenv("DB_HOST")
+	port := os.Getenv("DB_PORT")
+	user := os.Getenv("DB_USER")
+	password := os.Getenv("DB_PASSWORD")
+	databaseName := os.Getenv("DB_NAME")
+
+	connection := fmt.Sprintf(
+		"host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
+		host,
+		port,
+		user,
+		password,
+		databaseName,
+	)
+	db, _ := sql.Open("postgres", connection)
+
+	sess, _ := session.NewSession(&aws.Config{
+		Region: region,
+	})
+	service := emrserverless.New(sess)
+
+	recon = reconciler.New(db, service, applicationId, signingSecret)
+	idempotencyDb = db
+}
+
+func main() {
+	lambda.Start(HandleRequest)
+}
+
+// HandleRequest is invoked on the EventBridge schedule and reconciles all
+// non-terminal job runs, then sweeps expired Idempotency-Key hashes.
+func HandleRequest() error {
+	logger := log.WithFields(log.Fields{"source": "ExportQueryAPI-reconciler"})
+
+	updated, err := recon.Run()
+	if err != nil {
+		logger.Error(fmt.Sprintf("Reconciliation run failed with error: %v", err.Error()))
+		return err
+	}
+	logger.Info(fmt.Sprintf("Reconciliation run updated %v job(s)", updated))
+
+	swept, err := idempotency.Sweep(idempotencyDb, idempotencyKeyTTL)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Idempotency key sweep failed with error: %v", err.Error()))
+		return err
+	}
+	logger.Info(fmt.Sprintf("Idempotency key sweep cleared %v row(s)", swept))
+
+	return nil
+}
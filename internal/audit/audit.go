@@ -0,0 +1,115 @@
+// Package audit records a structured, PII-redacted trail of every query
+// HandleRequest runs, writing a separate audit_log row for each
+// emr_job_details row.
+package audit
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+)
+
+// Record is a single audit_log entry.
+type Record struct {
+	QueryId       string
+	Jti           string
+	ClientIp      string
+	VaultId       string
+	RedactedQuery string
+	LiteralHashes []string
+	Timestamp     time.Time
+	Action        string
+}
+
+// envelope is the JSON blob stored in audit_log.encryptedrawquery: an
+// AES-256-GCM ciphertext alongside the KMS-wrapped data key that encrypted
+// it, so decryption only ever needs one KMS Decrypt call regardless of
+// rawQuery's length.
+type envelope struct {
+	EncryptedDataKey string `json:"encryptedDataKey"`
+	Nonce            string `json:"nonce"`
+	Ciphertext       string `json:"ciphertext"`
+}
+
+// Write inserts record into audit_log using tx, so it commits or rolls back
+// with whatever else the caller runs on tx. HandleRequest calls it in a
+// transaction of its own after the emr_job_details row has committed, so the
+// two rows are not written atomically. When AUDIT_STORE_RAW=true,
+// rawQuery is additionally encrypted under a per-call KMS data key
+// (referenced by AUDIT_KMS_KEY_ID) and stored alongside the redacted query.
+func Write(tx *sql.Tx, record Record, rawQuery string) error {
+	literalHashes, err := json.Marshal(record.LiteralHashes)
+	if err != nil {
+		return err
+	}
+
+	var encryptedRawQuery sql.NullString
+	if strings.EqualFold(os.Getenv("AUDIT_STORE_RAW"), "true") {
+		ciphertext, err := encryptRaw(rawQuery)
+		if err != nil {
+			return err
+		}
+		encryptedRawQuery = sql.NullString{String: ciphertext, Valid: true}
+	}
+
+	statement := `INSERT INTO "audit_log"("queryid", "jti", "clientip", "vaultid", "redactedquery", "literalhashes", "createdat", "action", "encryptedrawquery") VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9)`
+
+	_, err = tx.Exec(statement, record.QueryId, record.Jti, record.ClientIp, record.VaultId, record.RedactedQuery, literalHashes, record.Timestamp, record.Action, encryptedRawQuery)
+	return err
+}
+
+// encryptRaw envelope-encrypts plaintext: it asks KMS for a fresh data key
+// under AUDIT_KMS_KEY_ID, encrypts plaintext locally with AES-256-GCM, and
+// returns the base64-encoded envelope. Unlike calling kms.Encrypt directly,
+// this isn't bounded by KMS's 4096-byte plaintext limit.
+func encryptRaw(plaintext string) (string, error) {
+	sess, err := session.NewSession(&aws.Config{Region: aws.String(os.Getenv("REGION"))})
+	if err != nil {
+		return "", err
+	}
+
+	dataKeyOutput, err := kms.New(sess).GenerateDataKey(&kms.GenerateDataKeyInput{
+		KeyId:   aws.String(os.Getenv("AUDIT_KMS_KEY_ID")),
+		KeySpec: aws.String("AES_256"),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	block, err := aes.NewCipher(dataKeyOutput.Plaintext)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	ciphertext := gcm.Seal(nil, nonce, []byte(plaintext), nil)
+
+	blob, err := json.Marshal(envelope{
+		EncryptedDataKey: base64.StdEncoding.EncodeToString(dataKeyOutput.CiphertextBlob),
+		Nonce:            base64.StdEncoding.EncodeToString(nonce),
+		Ciphertext:       base64.StdEncoding.EncodeToString(ciphertext),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(blob), nil
+}
@@ -0,0 +1,111 @@
+package audit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// Redact tokenizes a SQL query and replaces every string and numeric
+// literal with `?`, leaving comments and identifiers untouched. It returns
+// the redacted query alongside a SHA-256 hash of each literal it removed,
+// so the original values can be correlated without being stored.
+func Redact(query string) (string, []string) {
+	var out strings.Builder
+	var hashes []string
+
+	runes := []byte(query)
+	n := len(runes)
+	i := 0
+
+	for i < n {
+		c := runes[i]
+
+		switch {
+		case c == '\'':
+			end := quotedStringEnd(runes, i)
+			hashes = append(hashes, hashLiteral(string(runes[i:end])))
+			out.WriteByte('?')
+			i = end
+
+		case c == '-' && i+1 < n && runes[i+1] == '-':
+			end := i
+			for end < n && runes[end] != '\n' {
+				end++
+			}
+			out.Write(runes[i:end])
+			i = end
+
+		case c == '/' && i+1 < n && runes[i+1] == '*':
+			end := i + 2
+			for end+1 < n && !(runes[end] == '*' && runes[end+1] == '/') {
+				end++
+			}
+			end = min(end+2, n)
+			out.Write(runes[i:end])
+			i = end
+
+		case isDigit(c) && !precededByIdentChar(runes, i):
+			end := i
+			for end < n && (isDigit(runes[end]) || runes[end] == '.') {
+				end++
+			}
+			hashes = append(hashes, hashLiteral(string(runes[i:end])))
+			out.WriteByte('?')
+			i = end
+
+		default:
+			out.WriteByte(c)
+			i++
+		}
+	}
+
+	return out.String(), hashes
+}
+
+// quotedStringEnd returns the index just past the closing quote of the
+// string literal starting at start, honoring doubled-quote and backslash
+// escapes.
+func quotedStringEnd(s []byte, start int) int {
+	i := start + 1
+	n := len(s)
+	for i < n {
+		if s[i] == '\\' && i+1 < n {
+			i += 2
+			continue
+		}
+		if s[i] == '\'' {
+			if i+1 < n && s[i+1] == '\'' {
+				i += 2
+				continue
+			}
+			return i + 1
+		}
+		i++
+	}
+	return n
+}
+
+func precededByIdentChar(s []byte, i int) bool {
+	if i == 0 {
+		return false
+	}
+	prev := s[i-1]
+	return prev == '_' || (prev >= 'a' && prev <= 'z') || (prev >= 'A' && prev <= 'Z') || isDigit(prev)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func hashLiteral(literal string) string {
+	sum := sha256.Sum256([]byte(literal))
+	return hex.EncodeToString(sum[:])
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
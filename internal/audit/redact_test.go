@@ -0,0 +1,70 @@
+package audit
+
+import "testing"
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		expected string
+	}{
+		{
+			name:     "quoted string literal",
+			query:    `SELECT * FROM customers WHERE ssn = 'abc-123-xyz'`,
+			expected: `SELECT * FROM customers WHERE ssn = ?`,
+		},
+		{
+			name:     "numeric literal",
+			query:    `SELECT * FROM orders WHERE total > 4200`,
+			expected: `SELECT * FROM orders WHERE total > ?`,
+		},
+		{
+			name:     "escaped quote inside string",
+			query:    `SELECT * FROM notes WHERE body = 'it''s confidential'`,
+			expected: `SELECT * FROM notes WHERE body = ?`,
+		},
+		{
+			name:     "backslash escape inside string",
+			query:    `SELECT * FROM notes WHERE body = 'line1\'line2'`,
+			expected: `SELECT * FROM notes WHERE body = ?`,
+		},
+		{
+			name:     "line comment is preserved",
+			query:    "SELECT * FROM t -- literal 'kept' here\nWHERE id = 1",
+			expected: "SELECT * FROM t -- literal 'kept' here\nWHERE id = ?",
+		},
+		{
+			name:     "block comment is preserved",
+			query:    `SELECT * FROM t /* note 'kept' */ WHERE id = 1`,
+			expected: `SELECT * FROM t /* note 'kept' */ WHERE id = ?`,
+		},
+		{
+			name:     "column name with digits is untouched",
+			query:    `SELECT col1 FROM t2 WHERE id = 5`,
+			expected: `SELECT col1 FROM t2 WHERE id = ?`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			redacted, hashes := Redact(tt.query)
+			if redacted != tt.expected {
+				t.Errorf("got %q, want %q", redacted, tt.expected)
+			}
+			if len(hashes) == 0 {
+				t.Error("expected at least one literal hash")
+			}
+		})
+	}
+}
+
+func TestRedactIsDeterministic(t *testing.T) {
+	query := `SELECT * FROM t WHERE ssn = '123-45-6789'`
+
+	_, hashesA := Redact(query)
+	_, hashesB := Redact(query)
+
+	if len(hashesA) != 1 || len(hashesB) != 1 || hashesA[0] != hashesB[0] {
+		t.Errorf("expected identical literal hashes across runs, got %v and %v", hashesA, hashesB)
+	}
+}
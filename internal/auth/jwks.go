@@ -0,0 +1,150 @@
+package auth
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// jwk is a single entry of a JSON Web Key Set, as published by Skyflow.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+type jwkSet struct {
+	Keys []jwk `json:"keys"`
+}
+
+// KeyCache fetches Skyflow's JWKS and caches RSA public keys by kid. Key
+// re-fetches the set synchronously once the TTL elapses or a kid is unknown;
+// StartBackgroundRefresh additionally re-fetches it on a fixed interval.
+type KeyCache struct {
+	jwksUrl    string
+	ttl        time.Duration
+	httpClient *http.Client
+
+	mu        sync.RWMutex
+	keys      map[string]*rsa.PublicKey
+	fetchedAt time.Time
+}
+
+// NewKeyCache builds a KeyCache that fetches jwksUrl and keeps keys fresh for ttl.
+func NewKeyCache(jwksUrl string, ttl time.Duration) *KeyCache {
+	return &KeyCache{
+		jwksUrl:    jwksUrl,
+		ttl:        ttl,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		keys:       map[string]*rsa.PublicKey{},
+	}
+}
+
+// Key returns the RSA public key for kid, refreshing the cache first if it
+// is stale or the kid is unknown.
+func (c *KeyCache) Key(kid string) (*rsa.PublicKey, error) {
+	key, fresh := c.lookup(kid)
+	if fresh {
+		return key, nil
+	}
+
+	if err := c.refresh(); err != nil {
+		if key != nil {
+			return key, nil
+		}
+		return nil, err
+	}
+
+	key, _ = c.lookup(kid)
+	if key == nil {
+		return nil, fmt.Errorf("no JWKS key found for kid %q", kid)
+	}
+	return key, nil
+}
+
+// lookup returns the cached key for kid (if any) and whether the cache is
+// still within its TTL and doesn't need a refresh.
+func (c *KeyCache) lookup(kid string) (*rsa.PublicKey, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	key := c.keys[kid]
+	fresh := key != nil && time.Since(c.fetchedAt) < c.ttl
+	return key, fresh
+}
+
+// refresh re-fetches the JWKS document and rebuilds the key cache.
+func (c *KeyCache) refresh() error {
+	response, err := c.httpClient.Get(c.jwksUrl)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching JWKS returned status %v", response.StatusCode)
+	}
+
+	var set jwkSet
+	if err := json.NewDecoder(response.Body).Decode(&set); err != nil {
+		return err
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, key := range set.Keys {
+		if key.Kty != "RSA" {
+			continue
+		}
+		publicKey, err := key.rsaPublicKey()
+		if err != nil {
+			continue
+		}
+		keys[key.Kid] = publicKey
+	}
+
+	c.mu.Lock()
+	c.keys = keys
+	c.fetchedAt = time.Now()
+	c.mu.Unlock()
+
+	return nil
+}
+
+// StartBackgroundRefresh refreshes the cache every interval until stopped.
+func (c *KeyCache) StartBackgroundRefresh(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.refresh()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+func (k jwk) rsaPublicKey() (*rsa.PublicKey, error) {
+	nBytes, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, err
+	}
+	eBytes, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(nBytes),
+		E: int(new(big.Int).SetBytes(eBytes).Int64()),
+	}, nil
+}
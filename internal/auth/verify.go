@@ -0,0 +1,70 @@
+// Package auth validates Skyflow-issued JWTs against Skyflow's published
+// JWKS, replacing the previous ParseUnverified-based jti extraction.
+package auth
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// Verifier validates JWTs against a JWKS-backed key cache.
+type Verifier struct {
+	cache    *KeyCache
+	issuer   string
+	audience string
+}
+
+// NewVerifier builds a Verifier that fetches keys from jwksUrl, caching them
+// for ttl between refreshes. issuer/audience may be empty to skip that check.
+func NewVerifier(jwksUrl string, issuer string, audience string, ttl time.Duration) *Verifier {
+	return &Verifier{
+		cache:    NewKeyCache(jwksUrl, ttl),
+		issuer:   issuer,
+		audience: audience,
+	}
+}
+
+// StartBackgroundRefresh keeps v's JWKS cache warm by refreshing it every
+// interval until stop is closed, so the first request after the cache's TTL
+// elapses doesn't pay for a synchronous JWKS fetch.
+func (v *Verifier) StartBackgroundRefresh(interval time.Duration, stop <-chan struct{}) {
+	v.cache.StartBackgroundRefresh(interval, stop)
+}
+
+// Verify parses tokenString, checks its signature against the JWKS cache,
+// and validates exp, nbf, iss and aud before returning its claims.
+func (v *Verifier) Verify(tokenString string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+
+		kid, ok := token.Header["kid"].(string)
+		if !ok {
+			return nil, fmt.Errorf("token header is missing kid")
+		}
+
+		return v.cache.Key(kid)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !token.Valid {
+		return nil, fmt.Errorf("token is not valid")
+	}
+
+	if v.issuer != "" && !claims.VerifyIssuer(v.issuer, true) {
+		return nil, fmt.Errorf("token has an unexpected issuer")
+	}
+
+	if v.audience != "" && !claims.VerifyAudience(v.audience, true) {
+		return nil, fmt.Errorf("token has an unexpected audience")
+	}
+
+	return claims, nil
+}
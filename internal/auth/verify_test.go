@@ -0,0 +1,125 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+func startJWKSServer(t *testing.T, key *rsa.PrivateKey, kid string) *httptest.Server {
+	t.Helper()
+
+	set := jwkSet{Keys: []jwk{{
+		Kty: "RSA",
+		Kid: kid,
+		Alg: "RS256",
+		N:   base64.RawURLEncoding.EncodeToString(key.PublicKey.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.PublicKey.E)).Bytes()),
+	}}}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(set)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func signToken(t *testing.T, key *rsa.PrivateKey, kid string, claims jwt.MapClaims) string {
+	t.Helper()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+	return signed
+}
+
+func TestVerifyTableDriven(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	server := startJWKSServer(t, key, "test-kid")
+	verifier := NewVerifier(server.URL, "skyflow", "export-query-api", time.Minute)
+
+	validClaims := jwt.MapClaims{
+		"jti": "abc-123",
+		"iss": "skyflow",
+		"aud": "export-query-api",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{
+			name:  "valid token",
+			token: signToken(t, key, "test-kid", validClaims),
+		},
+		{
+			name:    "wrong signing key",
+			token:   signToken(t, otherKey, "test-kid", validClaims),
+			wantErr: true,
+		},
+		{
+			name: "expired token",
+			token: signToken(t, key, "test-kid", jwt.MapClaims{
+				"jti": "abc-123",
+				"iss": "skyflow",
+				"aud": "export-query-api",
+				"exp": time.Now().Add(-time.Hour).Unix(),
+			}),
+			wantErr: true,
+		},
+		{
+			name: "wrong issuer",
+			token: signToken(t, key, "test-kid", jwt.MapClaims{
+				"jti": "abc-123",
+				"iss": "someone-else",
+				"aud": "export-query-api",
+				"exp": time.Now().Add(time.Hour).Unix(),
+			}),
+			wantErr: true,
+		},
+		{
+			name:    "unknown kid",
+			token:   signToken(t, key, "unknown-kid", validClaims),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := verifier.Verify(tt.token)
+			if tt.wantErr && err == nil {
+				t.Fatal("expected an error, got nil")
+			}
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if claims["jti"] != "abc-123" {
+					t.Errorf("expected jti abc-123, got %v", claims["jti"])
+				}
+			}
+		})
+	}
+}
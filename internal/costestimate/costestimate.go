@@ -0,0 +1,212 @@
+// Package costestimate runs a query-planning pre-flight against a
+// vault-metadata Postgres replica before a query is handed to EMR
+// Serverless, rejecting queries whose plan would burn excessive capacity.
+package costestimate
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Estimate is the planner's prediction for a query.
+type Estimate struct {
+	TotalCost float64
+	PlanRows  float64
+}
+
+type explainPlan struct {
+	Plan struct {
+		TotalCost float64 `json:"Total Cost"`
+		PlanRows  float64 `json:"Plan Rows"`
+	} `json:"Plan"`
+}
+
+type cacheEntry struct {
+	estimate  Estimate
+	fetchedAt time.Time
+}
+
+// Thresholds configures the pre-flight's rejection limits.
+type Thresholds struct {
+	MaxPlanCost float64
+	MaxPlanRows float64
+}
+
+// Estimator plans queries against a read-only replica and caches the result.
+//
+// The replica connection is expected to authenticate as a SELECT-only
+// Postgres role (see REPLICA_DB_USER) — EXPLAIN still executes whatever it's
+// given, so the role's own grants are the backstop once Estimate has ruled
+// out stacked statements.
+type Estimator struct {
+	replica          *sql.DB
+	thresholds       Thresholds
+	cacheTTL         time.Duration
+	statementTimeout time.Duration
+
+	mu    sync.Mutex
+	cache map[string]cacheEntry
+}
+
+// New builds an Estimator backed by replica, caching estimates for cacheTTL
+// and bounding each EXPLAIN with statementTimeout.
+func New(replica *sql.DB, thresholds Thresholds, cacheTTL time.Duration, statementTimeout time.Duration) *Estimator {
+	return &Estimator{
+		replica:          replica,
+		thresholds:       thresholds,
+		cacheTTL:         cacheTTL,
+		statementTimeout: statementTimeout,
+		cache:            map[string]cacheEntry{},
+	}
+}
+
+// Estimate returns the planner's cost estimate for query, using a cached
+// value when one was fetched within cacheTTL.
+func (e *Estimator) Estimate(query string) (Estimate, error) {
+	key := queryKey(query)
+
+	if estimate, ok := e.cached(key); ok {
+		return estimate, nil
+	}
+
+	if err := rejectStackedStatements(query); err != nil {
+		return Estimate{}, err
+	}
+
+	tx, err := e.replica.Begin()
+	if err != nil {
+		return Estimate{}, err
+	}
+	defer tx.Rollback()
+
+	timeoutMs := e.statementTimeout.Milliseconds()
+	if _, err := tx.Exec(fmt.Sprintf("SET LOCAL statement_timeout = %d", timeoutMs)); err != nil {
+		return Estimate{}, err
+	}
+
+	var planJson string
+	row := tx.QueryRow(fmt.Sprintf("EXPLAIN (FORMAT JSON) %s", query))
+	if err := row.Scan(&planJson); err != nil {
+		return Estimate{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Estimate{}, err
+	}
+
+	var plans []explainPlan
+	if err := json.Unmarshal([]byte(planJson), &plans); err != nil {
+		return Estimate{}, err
+	}
+	if len(plans) == 0 {
+		return Estimate{}, fmt.Errorf("EXPLAIN returned no plan")
+	}
+
+	estimate := Estimate{TotalCost: plans[0].Plan.TotalCost, PlanRows: plans[0].Plan.PlanRows}
+
+	e.mu.Lock()
+	e.cache[key] = cacheEntry{estimate: estimate, fetchedAt: time.Now()}
+	e.mu.Unlock()
+
+	return estimate, nil
+}
+
+func (e *Estimator) cached(key string) (Estimate, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	entry, ok := e.cache[key]
+	if !ok || time.Since(entry.fetchedAt) >= e.cacheTTL {
+		return Estimate{}, false
+	}
+	return entry.estimate, true
+}
+
+// CheckThresholds returns an error describing which threshold estimate
+// exceeds, or nil if it is within Thresholds.
+func (e *Estimator) CheckThresholds(estimate Estimate) error {
+	if estimate.TotalCost > e.thresholds.MaxPlanCost {
+		return fmt.Errorf("estimated plan cost %.2f exceeds MAX_PLAN_COST %.2f", estimate.TotalCost, e.thresholds.MaxPlanCost)
+	}
+	if estimate.PlanRows > e.thresholds.MaxPlanRows {
+		return fmt.Errorf("estimated plan rows %.0f exceeds MAX_PLAN_ROWS %.0f", estimate.PlanRows, e.thresholds.MaxPlanRows)
+	}
+	return nil
+}
+
+// rejectStackedStatements rejects query unless it is a single SELECT
+// statement, so a caller can't smuggle a second statement into the
+// interpolated EXPLAIN text (e.g. "SELECT 1; DROP TABLE vaults").
+// A single trailing semicolon is tolerated.
+func rejectStackedStatements(query string) error {
+	trimmed := strings.TrimSpace(query)
+	if trimmed == "" {
+		return fmt.Errorf("query must not be empty")
+	}
+	if !strings.HasPrefix(strings.ToUpper(trimmed), "SELECT") {
+		return fmt.Errorf("only SELECT queries can be cost-estimated")
+	}
+
+	runes := []byte(trimmed)
+	n := len(runes)
+	i := 0
+	for i < n {
+		c := runes[i]
+		switch {
+		case c == '\'':
+			i = quotedStringEnd(runes, i)
+		case c == '-' && i+1 < n && runes[i+1] == '-':
+			for i < n && runes[i] != '\n' {
+				i++
+			}
+		case c == '/' && i+1 < n && runes[i+1] == '*':
+			i += 2
+			for i+1 < n && !(runes[i] == '*' && runes[i+1] == '/') {
+				i++
+			}
+			i += 2
+		case c == ';':
+			if strings.TrimSpace(string(runes[i+1:])) != "" {
+				return fmt.Errorf("query must be a single statement")
+			}
+			return nil
+		default:
+			i++
+		}
+	}
+	return nil
+}
+
+// quotedStringEnd returns the index just past the closing quote of the
+// string literal starting at start, honoring doubled-quote and backslash
+// escapes.
+func quotedStringEnd(s []byte, start int) int {
+	i := start + 1
+	n := len(s)
+	for i < n {
+		if s[i] == '\\' && i+1 < n {
+			i += 2
+			continue
+		}
+		if s[i] == '\'' {
+			if i+1 < n && s[i+1] == '\'' {
+				i += 2
+				continue
+			}
+			return i + 1
+		}
+		i++
+	}
+	return n
+}
+
+func queryKey(query string) string {
+	sum := sha256.Sum256([]byte(query))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,29 @@
+package costestimate
+
+import "testing"
+
+func TestRejectStackedStatements(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		wantErr bool
+	}{
+		{name: "plain select", query: "SELECT * FROM customers WHERE id = 1", wantErr: false},
+		{name: "trailing semicolon tolerated", query: "SELECT * FROM customers;", wantErr: false},
+		{name: "trailing whitespace after semicolon tolerated", query: "SELECT * FROM customers; \n", wantErr: false},
+		{name: "semicolon inside string literal is not a stacked statement", query: "SELECT * FROM customers WHERE note = 'a;b'", wantErr: false},
+		{name: "semicolon inside line comment is not a stacked statement", query: "SELECT * FROM customers -- drop it; right?\nWHERE id = 1", wantErr: false},
+		{name: "stacked statement rejected", query: "SELECT 1; DROP TABLE customers", wantErr: true},
+		{name: "non-select rejected", query: "DELETE FROM customers", wantErr: true},
+		{name: "empty query rejected", query: "   ", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := rejectStackedStatements(tt.query)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("rejectStackedStatements(%q) error = %v, wantErr %v", tt.query, err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+// Package destination parses and validates the export destination URI
+// supplied in a request body and normalizes it into a descriptor that the
+// Spark job's entry point arguments can use to pick the right connector.
+package destination
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Backend identifies which storage connector a Descriptor targets.
+type Backend string
+
+const (
+	S3           Backend = "s3"
+	GCS          Backend = "gs"
+	Azure        Backend = "az"
+	S3Compatible Backend = "s3-compatible"
+)
+
+// Descriptor is the normalized, backend-agnostic description of an export
+// destination, passed through to the Spark job via entryPointArguments.
+type Descriptor struct {
+	Backend   Backend
+	Bucket    string
+	Path      string
+	Region    string
+	Endpoint  string
+	PathStyle bool
+}
+
+// Destination validates a parsed URI against the requirements of its backend.
+type Destination interface {
+	Descriptor() Descriptor
+	Validate() error
+}
+
+var schemePattern = regexp.MustCompile(`^(s3|gs|az)://([^/]+)/(.*?([^/]+)/?)$`)
+
+// enabledBackends reports which backends this deployment allows, driven by
+// the comma-separated ENABLED_DESTINATION_BACKENDS env var. An empty value
+// allows every backend, preserving the historical S3-only behaviour only if
+// operators opt into restricting it.
+func enabledBackends() map[Backend]bool {
+	raw := os.Getenv("ENABLED_DESTINATION_BACKENDS")
+	if raw == "" {
+		return map[Backend]bool{S3: true, GCS: true, Azure: true, S3Compatible: true}
+	}
+
+	enabled := map[Backend]bool{}
+	for _, backend := range strings.Split(raw, ",") {
+		enabled[Backend(strings.TrimSpace(backend))] = true
+	}
+	return enabled
+}
+
+// New parses uri and returns the Destination implementation for its scheme.
+// region is used as the default region for backends that need one.
+func New(uri string, region string) (Destination, error) {
+	matches := schemePattern.FindStringSubmatch(uri)
+	if matches == nil {
+		return nil, fmt.Errorf("invalid destination path: %v", uri)
+	}
+
+	scheme := Backend(matches[1])
+	bucket := matches[2]
+	path := matches[3]
+
+	backend := scheme
+	endpoint := os.Getenv("S3_COMPATIBLE_ENDPOINT")
+	if scheme == S3 && endpoint != "" {
+		backend = S3Compatible
+	}
+
+	if !enabledBackends()[backend] {
+		return nil, fmt.Errorf("destination backend %q is not enabled", backend)
+	}
+
+	descriptor := Descriptor{
+		Backend: backend,
+		Bucket:  bucket,
+		Path:    path,
+		Region:  region,
+	}
+
+	switch backend {
+	case S3:
+		return &s3Destination{descriptor}, nil
+	case GCS:
+		return &gcsDestination{descriptor}, nil
+	case Azure:
+		return &azureDestination{descriptor}, nil
+	case S3Compatible:
+		descriptor.Endpoint = endpoint
+		descriptor.PathStyle = strings.EqualFold(os.Getenv("S3_COMPATIBLE_PATH_STYLE"), "true")
+		return &s3CompatibleDestination{descriptor}, nil
+	default:
+		return nil, fmt.Errorf("unsupported destination backend %q", backend)
+	}
+}
+
+type s3Destination struct{ descriptor Descriptor }
+
+func (d *s3Destination) Descriptor() Descriptor { return d.descriptor }
+
+func (d *s3Destination) Validate() error {
+	if d.descriptor.Region == "" {
+		return fmt.Errorf("region is required for s3 destinations")
+	}
+	return nil
+}
+
+type gcsDestination struct{ descriptor Descriptor }
+
+func (d *gcsDestination) Descriptor() Descriptor { return d.descriptor }
+
+func (d *gcsDestination) Validate() error {
+	if os.Getenv("GCS_CREDENTIALS_SECRET") == "" {
+		return fmt.Errorf("GCS_CREDENTIALS_SECRET must be configured for gs destinations")
+	}
+	return nil
+}
+
+type azureDestination struct{ descriptor Descriptor }
+
+func (d *azureDestination) Descriptor() Descriptor { return d.descriptor }
+
+func (d *azureDestination) Validate() error {
+	if os.Getenv("AZURE_STORAGE_ACCOUNT") == "" {
+		return fmt.Errorf("AZURE_STORAGE_ACCOUNT must be configured for az destinations")
+	}
+	return nil
+}
+
+type s3CompatibleDestination struct{ descriptor Descriptor }
+
+func (d *s3CompatibleDestination) Descriptor() Descriptor { return d.descriptor }
+
+func (d *s3CompatibleDestination) Validate() error {
+	if d.descriptor.Endpoint == "" {
+		return fmt.Errorf("S3_COMPATIBLE_ENDPOINT must be configured for s3-compatible destinations")
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package destination
+
+import (
+	"os"
+	"testing"
+)
+
+func TestNewS3(t *testing.T) {
+	dest, err := New("s3://my-bucket/path/to/export/", "us-east-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	descriptor := dest.Descriptor()
+	if descriptor.Backend != S3 {
+		t.Errorf("expected backend %v, got %v", S3, descriptor.Backend)
+	}
+	if descriptor.Bucket != "my-bucket" {
+		t.Errorf("expected bucket my-bucket, got %v", descriptor.Bucket)
+	}
+	if err := dest.Validate(); err != nil {
+		t.Errorf("unexpected validation error: %v", err)
+	}
+}
+
+func TestNewGCS(t *testing.T) {
+	t.Setenv("GCS_CREDENTIALS_SECRET", "")
+
+	dest, err := New("gs://my-bucket/path/to/export/", "us-east-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if dest.Descriptor().Backend != GCS {
+		t.Errorf("expected backend %v, got %v", GCS, dest.Descriptor().Backend)
+	}
+	if err := dest.Validate(); err == nil {
+		t.Error("expected validation error when GCS_CREDENTIALS_SECRET is unset")
+	}
+
+	t.Setenv("GCS_CREDENTIALS_SECRET", "arn:aws:secretsmanager:...")
+	if err := dest.Validate(); err != nil {
+		t.Errorf("unexpected validation error: %v", err)
+	}
+}
+
+func TestNewAzure(t *testing.T) {
+	t.Setenv("AZURE_STORAGE_ACCOUNT", "")
+
+	dest, err := New("az://my-container/path/to/export/", "us-east-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if dest.Descriptor().Backend != Azure {
+		t.Errorf("expected backend %v, got %v", Azure, dest.Descriptor().Backend)
+	}
+	if err := dest.Validate(); err == nil {
+		t.Error("expected validation error when AZURE_STORAGE_ACCOUNT is unset")
+	}
+}
+
+func TestNewS3Compatible(t *testing.T) {
+	t.Setenv("S3_COMPATIBLE_ENDPOINT", "https://minio.internal:9000")
+	t.Setenv("S3_COMPATIBLE_PATH_STYLE", "true")
+
+	dest, err := New("s3://my-bucket/path/to/export/", "us-east-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	descriptor := dest.Descriptor()
+	if descriptor.Backend != S3Compatible {
+		t.Errorf("expected backend %v, got %v", S3Compatible, descriptor.Backend)
+	}
+	if descriptor.Endpoint != "https://minio.internal:9000" {
+		t.Errorf("expected endpoint to be carried through, got %v", descriptor.Endpoint)
+	}
+	if !descriptor.PathStyle {
+		t.Error("expected path style addressing to be enabled")
+	}
+}
+
+func TestNewInvalidURI(t *testing.T) {
+	if _, err := New("not-a-uri", "us-east-1"); err == nil {
+		t.Error("expected error for invalid destination URI")
+	}
+}
+
+func TestNewDisabledBackend(t *testing.T) {
+	t.Setenv("ENABLED_DESTINATION_BACKENDS", "s3")
+
+	if _, err := New("gs://my-bucket/path/", "us-east-1"); err == nil {
+		t.Error("expected error when gs backend is not in the allowlist")
+	}
+
+	os.Unsetenv("ENABLED_DESTINATION_BACKENDS")
+}
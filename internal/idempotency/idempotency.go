@@ -0,0 +1,31 @@
+// Package idempotency lets callers safely retry a POST to HandleRequest
+// without launching a duplicate EMR Serverless job, keyed off the
+// client-supplied Idempotency-Key header.
+package idempotency
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"time"
+)
+
+// Hash derives the unique key stored in emr_job_details.idempotency_hash
+// from the tuple that identifies "the same request" for retry purposes.
+func Hash(idempotencyKey string, jti string, vaultId string, query string, destination string) string {
+	sum := sha256.Sum256([]byte(idempotencyKey + "|" + jti + "|" + vaultId + "|" + query + "|" + destination))
+	return hex.EncodeToString(sum[:])
+}
+
+// Sweep clears idempotency hashes older than ttl, freeing their keys for
+// reuse by new requests. It's intended to run on a schedule (see
+// cmd/reconciler) and returns the number of rows cleared.
+func Sweep(db *sql.DB, ttl time.Duration) (int64, error) {
+	statement := `UPDATE "emr_job_details" SET "idempotency_hash" = NULL WHERE "idempotency_hash" IS NOT NULL AND "createdat" < $1`
+
+	result, err := db.Exec(statement, time.Now().Add(-ttl))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
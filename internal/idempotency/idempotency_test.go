@@ -0,0 +1,64 @@
+package idempotency
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestHashIsDeterministic(t *testing.T) {
+	a := Hash("key-1", "jti-1", "vault-1", "SELECT 1", "s3://bucket/path")
+	b := Hash("key-1", "jti-1", "vault-1", "SELECT 1", "s3://bucket/path")
+
+	if a != b {
+		t.Errorf("expected identical hashes for identical inputs, got %q and %q", a, b)
+	}
+}
+
+func TestHashDiffersOnAnyField(t *testing.T) {
+	base := Hash("key-1", "jti-1", "vault-1", "SELECT 1", "s3://bucket/path")
+
+	tests := []struct {
+		name string
+		hash string
+	}{
+		{"idempotencyKey", Hash("key-2", "jti-1", "vault-1", "SELECT 1", "s3://bucket/path")},
+		{"jti", Hash("key-1", "jti-2", "vault-1", "SELECT 1", "s3://bucket/path")},
+		{"vaultId", Hash("key-1", "jti-1", "vault-2", "SELECT 1", "s3://bucket/path")},
+		{"query", Hash("key-1", "jti-1", "vault-1", "SELECT 2", "s3://bucket/path")},
+		{"destination", Hash("key-1", "jti-1", "vault-1", "SELECT 1", "s3://bucket/other")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.hash == base {
+				t.Errorf("expected hash to change when %s differs", tt.name)
+			}
+		})
+	}
+}
+
+func TestSweepClearsExpiredHashes(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec(`UPDATE "emr_job_details" SET "idempotency_hash" = NULL WHERE "idempotency_hash" IS NOT NULL AND "createdat" < \$1`).
+		WithArgs(sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+
+	cleared, err := Sweep(db, 24*time.Hour)
+	if err != nil {
+		t.Fatalf("Sweep returned error: %v", err)
+	}
+	if cleared != 3 {
+		t.Errorf("got %d cleared rows, want 3", cleared)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
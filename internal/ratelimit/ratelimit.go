@@ -0,0 +1,194 @@
+// Package ratelimit bounds how many EMR Serverless jobs a caller can launch,
+// guarding against a single jti (or a buggy client) spamming HandleRequest
+// and running up EMR Serverless costs.
+package ratelimit
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// terminalJobStatuses mirrors the EMR Serverless JobRunState values that
+// mean a job is no longer occupying a concurrency slot.
+var terminalJobStatuses = []string{"SUCCESS", "FAILED", "CANCELLED"}
+
+// Thresholds configures the limits a Limiter enforces, sourced from env vars.
+type Thresholds struct {
+	MaxJobsPerMinute        int
+	MaxConcurrentJobsPerJTI int
+	MaxConcurrentJobsGlobal int
+}
+
+// Limiter enforces Thresholds against the emr_job_details table.
+type Limiter struct {
+	db         *sql.DB
+	thresholds Thresholds
+}
+
+// New builds a Limiter backed by db.
+func New(db *sql.DB, thresholds Thresholds) *Limiter {
+	return &Limiter{db: db, thresholds: thresholds}
+}
+
+// Decision is the outcome of a Reserve call.
+type Decision struct {
+	Allowed    bool
+	Reason     string
+	RetryAfter time.Duration
+
+	// Replayed is set when idempotencyHash matched a row from a prior call,
+	// in which case the Existing* fields describe that prior job and no new
+	// placeholder row was inserted.
+	Replayed            bool
+	ExistingId          string
+	ExistingJobId       string
+	ExistingJobStatus   string
+	ExistingRequestId   string
+	ExistingDestination string
+}
+
+// globalQuotaLockKey is a fixed key for the advisory lock guarding
+// MaxConcurrentJobsGlobal, independent of any jti.
+const globalQuotaLockKey = "emr-global-quota"
+
+// Reserve checks jti's rate and concurrency usage and, if it is within
+// Thresholds, inserts a PENDING placeholder row for id so the reservation is
+// immediately visible to concurrent invocations. The count queries and the
+// insert run inside a single transaction serialized on a per-jti advisory
+// lock, so two concurrent Lambda invocations for the same jti cannot both
+// slip past the limit. The global concurrency check is additionally guarded
+// by a second advisory lock on a fixed key, since two different jtis would
+// otherwise race past MaxConcurrentJobsGlobal under the per-jti lock alone.
+//
+// When idempotencyHash is non-empty it is stored on the placeholder row
+// under a unique index; if a row with that hash already exists, Reserve
+// returns a Replayed Decision describing it instead of inserting a duplicate.
+// The thresholds are checked before that lookup, so a retry from a jti that
+// is over a threshold is rejected rather than replayed.
+func (l *Limiter) Reserve(id string, jti string, clientIp string, idempotencyHash string) (Decision, error) {
+	tx, err := l.db.Begin()
+	if err != nil {
+		return Decision{}, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext($1))`, jti); err != nil {
+		return Decision{}, err
+	}
+
+	jobsThisMinute, err := l.countLocked(tx, `SELECT "id" FROM "emr_job_details" WHERE "jti" = $1 AND "createdat" > $2 FOR UPDATE`, jti, time.Now().Add(-time.Minute))
+	if err != nil {
+		return Decision{}, err
+	}
+	if jobsThisMinute >= l.thresholds.MaxJobsPerMinute {
+		return Decision{Allowed: false, Reason: "MAX_JOBS_PER_MINUTE", RetryAfter: time.Minute}, nil
+	}
+
+	concurrentForJti, err := l.countLocked(tx, nonTerminalForJtiQuery, jti)
+	if err != nil {
+		return Decision{}, err
+	}
+	if concurrentForJti >= l.thresholds.MaxConcurrentJobsPerJTI {
+		return Decision{Allowed: false, Reason: "MAX_CONCURRENT_JOBS_PER_JTI", RetryAfter: 30 * time.Second}, nil
+	}
+
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext($1))`, globalQuotaLockKey); err != nil {
+		return Decision{}, err
+	}
+
+	concurrentGlobal, err := l.countLocked(tx, nonTerminalGlobalQuery)
+	if err != nil {
+		return Decision{}, err
+	}
+	if concurrentGlobal >= l.thresholds.MaxConcurrentJobsGlobal {
+		return Decision{Allowed: false, Reason: "MAX_CONCURRENT_JOBS_GLOBAL", RetryAfter: 30 * time.Second}, nil
+	}
+
+	if idempotencyHash != "" {
+		statement := `INSERT INTO "emr_job_details"("id", "jobid", "jobstatus", "jti", "client_ip", "createdat", "idempotency_hash") VALUES($1, $2, $3, $4, $5, $6, $7) ON CONFLICT ("idempotency_hash") DO NOTHING`
+		result, err := tx.Exec(statement, id, "", "PENDING", jti, clientIp, time.Now(), idempotencyHash)
+		if err != nil {
+			return Decision{}, err
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return Decision{}, err
+		}
+
+		if rowsAffected == 0 {
+			decision, err := l.loadReplay(tx, idempotencyHash)
+			if err != nil {
+				return Decision{}, err
+			}
+			return decision, nil
+		}
+	} else {
+		statement := `INSERT INTO "emr_job_details"("id", "jobid", "jobstatus", "jti", "client_ip", "createdat") VALUES($1, $2, $3, $4, $5, $6)`
+		if _, err := tx.Exec(statement, id, "", "PENDING", jti, clientIp, time.Now()); err != nil {
+			return Decision{}, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Decision{}, err
+	}
+
+	return Decision{Allowed: true}, nil
+}
+
+// MarkFailed transitions id's PENDING placeholder row to FAILED and clears
+// any idempotency_hash it was reserved under. Callers must invoke this for
+// any request that fails after a successful, non-replayed Reserve call, so
+// the row doesn't sit PENDING — occupying a concurrency slot and answering
+// future Idempotency-Key replays with a job that never ran.
+func (l *Limiter) MarkFailed(id string) error {
+	statement := `UPDATE "emr_job_details" SET "jobstatus" = 'FAILED', "idempotency_hash" = NULL WHERE "id" = $1`
+	_, err := l.db.Exec(statement, id)
+	return err
+}
+
+func (l *Limiter) loadReplay(tx *sql.Tx, idempotencyHash string) (Decision, error) {
+	var existingId string
+	var jobId, jobStatus, requestId, destination sql.NullString
+
+	row := tx.QueryRow(`SELECT "id", "jobid", "jobstatus", "requestid", "destination" FROM "emr_job_details" WHERE "idempotency_hash" = $1`, idempotencyHash)
+	if err := row.Scan(&existingId, &jobId, &jobStatus, &requestId, &destination); err != nil {
+		return Decision{}, err
+	}
+
+	return Decision{
+		Allowed:             true,
+		Replayed:            true,
+		ExistingId:          existingId,
+		ExistingJobId:       jobId.String,
+		ExistingJobStatus:   jobStatus.String,
+		ExistingRequestId:   requestId.String,
+		ExistingDestination: destination.String,
+	}, nil
+}
+
+var nonTerminalForJtiQuery = fmt.Sprintf(
+	`SELECT "id" FROM "emr_job_details" WHERE "jti" = $1 AND "jobstatus" NOT IN ('%s', '%s', '%s') FOR UPDATE`,
+	terminalJobStatuses[0], terminalJobStatuses[1], terminalJobStatuses[2],
+)
+
+var nonTerminalGlobalQuery = fmt.Sprintf(
+	`SELECT "id" FROM "emr_job_details" WHERE "jobstatus" NOT IN ('%s', '%s', '%s') FOR UPDATE`,
+	terminalJobStatuses[0], terminalJobStatuses[1], terminalJobStatuses[2],
+)
+
+func (l *Limiter) countLocked(tx *sql.Tx, lockingQuery string, args ...interface{}) (int, error) {
+	rows, err := tx.Query(lockingQuery, args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	count := 0
+	for rows.Next() {
+		count++
+	}
+	return count, rows.Err()
+}
@@ -0,0 +1,183 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func newTestLimiter(t *testing.T) (*Limiter, sqlmock.Sqlmock) {
+	t.Helper()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return New(db, Thresholds{MaxJobsPerMinute: 10, MaxConcurrentJobsPerJTI: 3, MaxConcurrentJobsGlobal: 50}), mock
+}
+
+func TestReserveAllowsWithinThresholds(t *testing.T) {
+	limiter, mock := newTestLimiter(t)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`SELECT pg_advisory_xact_lock\(hashtext\(\$1\)\)`).
+		WithArgs("jti-1").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`SELECT "id" FROM "emr_job_details" WHERE "jti" = \$1 AND "createdat" > \$2 FOR UPDATE`).
+		WithArgs("jti-1", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectQuery(`SELECT "id" FROM "emr_job_details" WHERE "jti" = \$1 AND "jobstatus" NOT IN`).
+		WithArgs("jti-1").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectExec(`SELECT pg_advisory_xact_lock\(hashtext\(\$1\)\)`).
+		WithArgs(globalQuotaLockKey).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`SELECT "id" FROM "emr_job_details" WHERE "jobstatus" NOT IN`).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectExec(`INSERT INTO "emr_job_details"\("id", "jobid", "jobstatus", "jti", "client_ip", "createdat"\)`).
+		WithArgs("req-1", "", "PENDING", "jti-1", "1.2.3.4", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	decision, err := limiter.Reserve("req-1", "jti-1", "1.2.3.4", "")
+	if err != nil {
+		t.Fatalf("Reserve returned error: %v", err)
+	}
+	if !decision.Allowed || decision.Replayed {
+		t.Errorf("got %+v, want Allowed=true Replayed=false", decision)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestReserveRejectsOverPerMinuteThreshold(t *testing.T) {
+	limiter, mock := newTestLimiter(t)
+
+	rows := sqlmock.NewRows([]string{"id"})
+	for i := 0; i < 10; i++ {
+		rows.AddRow("existing")
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`SELECT pg_advisory_xact_lock\(hashtext\(\$1\)\)`).
+		WithArgs("jti-1").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`SELECT "id" FROM "emr_job_details" WHERE "jti" = \$1 AND "createdat" > \$2 FOR UPDATE`).
+		WithArgs("jti-1", sqlmock.AnyArg()).
+		WillReturnRows(rows)
+	mock.ExpectRollback()
+
+	decision, err := limiter.Reserve("req-1", "jti-1", "1.2.3.4", "")
+	if err != nil {
+		t.Fatalf("Reserve returned error: %v", err)
+	}
+	if decision.Allowed || decision.Reason != "MAX_JOBS_PER_MINUTE" {
+		t.Errorf("got %+v, want Allowed=false Reason=MAX_JOBS_PER_MINUTE", decision)
+	}
+	if decision.RetryAfter != time.Minute {
+		t.Errorf("got RetryAfter=%v, want %v", decision.RetryAfter, time.Minute)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestReserveRejectsOverGlobalThreshold(t *testing.T) {
+	limiter, mock := newTestLimiter(t)
+
+	globalRows := sqlmock.NewRows([]string{"id"})
+	for i := 0; i < 50; i++ {
+		globalRows.AddRow("existing")
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`SELECT pg_advisory_xact_lock\(hashtext\(\$1\)\)`).
+		WithArgs("jti-1").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`SELECT "id" FROM "emr_job_details" WHERE "jti" = \$1 AND "createdat" > \$2 FOR UPDATE`).
+		WithArgs("jti-1", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectQuery(`SELECT "id" FROM "emr_job_details" WHERE "jti" = \$1 AND "jobstatus" NOT IN`).
+		WithArgs("jti-1").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectExec(`SELECT pg_advisory_xact_lock\(hashtext\(\$1\)\)`).
+		WithArgs(globalQuotaLockKey).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`SELECT "id" FROM "emr_job_details" WHERE "jobstatus" NOT IN`).
+		WillReturnRows(globalRows)
+	mock.ExpectRollback()
+
+	decision, err := limiter.Reserve("req-1", "jti-1", "1.2.3.4", "")
+	if err != nil {
+		t.Fatalf("Reserve returned error: %v", err)
+	}
+	if decision.Allowed || decision.Reason != "MAX_CONCURRENT_JOBS_GLOBAL" {
+		t.Errorf("got %+v, want Allowed=false Reason=MAX_CONCURRENT_JOBS_GLOBAL", decision)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestReserveReplaysOnIdempotencyConflict(t *testing.T) {
+	limiter, mock := newTestLimiter(t)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`SELECT pg_advisory_xact_lock\(hashtext\(\$1\)\)`).
+		WithArgs("jti-1").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`SELECT "id" FROM "emr_job_details" WHERE "jti" = \$1 AND "createdat" > \$2 FOR UPDATE`).
+		WithArgs("jti-1", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectQuery(`SELECT "id" FROM "emr_job_details" WHERE "jti" = \$1 AND "jobstatus" NOT IN`).
+		WithArgs("jti-1").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectExec(`SELECT pg_advisory_xact_lock\(hashtext\(\$1\)\)`).
+		WithArgs(globalQuotaLockKey).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`SELECT "id" FROM "emr_job_details" WHERE "jobstatus" NOT IN`).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectExec(`INSERT INTO "emr_job_details"\("id", "jobid", "jobstatus", "jti", "client_ip", "createdat", "idempotency_hash"\)`).
+		WithArgs("req-1", "", "PENDING", "jti-1", "1.2.3.4", sqlmock.AnyArg(), "hash-1").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`SELECT "id", "jobid", "jobstatus", "requestid", "destination" FROM "emr_job_details" WHERE "idempotency_hash" = \$1`).
+		WithArgs("hash-1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "jobid", "jobstatus", "requestid", "destination"}).
+			AddRow("existing-req", "job-123", "SUCCESS", "skyflow-req-1", "s3://bucket/path"))
+	mock.ExpectRollback()
+
+	decision, err := limiter.Reserve("req-1", "jti-1", "1.2.3.4", "hash-1")
+	if err != nil {
+		t.Fatalf("Reserve returned error: %v", err)
+	}
+	if !decision.Replayed || decision.ExistingId != "existing-req" || decision.ExistingJobId != "job-123" {
+		t.Errorf("got %+v, want a replay of existing-req/job-123", decision)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestMarkFailed(t *testing.T) {
+	limiter, mock := newTestLimiter(t)
+
+	mock.ExpectExec(`UPDATE "emr_job_details" SET "jobstatus" = 'FAILED', "idempotency_hash" = NULL WHERE "id" = \$1`).
+		WithArgs("req-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := limiter.MarkFailed("req-1"); err != nil {
+		t.Fatalf("MarkFailed returned error: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
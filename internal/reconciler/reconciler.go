@@ -0,0 +1,191 @@
+// Package reconciler scans in-flight EMR Serverless job runs, refreshes
+// their status from AWS and notifies callers who registered a callback URL.
+// It backs the scheduled Lambda in cmd/reconciler.
+package reconciler
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/emrserverless"
+	log "github.com/sirupsen/logrus"
+)
+
+// terminalJobStatuses mirrors the EMR Serverless JobRunState enum values
+// that mean a job will never change state again.
+var terminalJobStatuses = []string{"SUCCESS", "FAILED", "CANCELLED"}
+
+// CallbackPayload is the JSON body POSTed to a job's callbackUrl.
+type CallbackPayload struct {
+	Id            string `json:"id"`
+	JobId         string `json:"jobId"`
+	JobStatus     string `json:"jobStatus"`
+	RequestId     string `json:"requestId"`
+	S3Destination string `json:"s3Destination"`
+	Error         string `json:"error,omitempty"`
+}
+
+type jobRow struct {
+	id           string
+	jobId        string
+	jobStatus    string
+	requestId    string
+	destination  string
+	callbackUrl  sql.NullString
+	stateDetails string
+}
+
+// Reconciler polls non-terminal emr_job_details rows against EMR Serverless
+// and notifies registered callback URLs when a job's status changes.
+type Reconciler struct {
+	db            *sql.DB
+	service       *emrserverless.EMRServerless
+	applicationId *string
+	signingSecret string
+	httpClient    *http.Client
+}
+
+// New builds a Reconciler. signingSecret is used to HMAC-sign callback payloads.
+func New(db *sql.DB, service *emrserverless.EMRServerless, applicationId *string, signingSecret string) *Reconciler {
+	return &Reconciler{
+		db:            db,
+		service:       service,
+		applicationId: applicationId,
+		signingSecret: signingSecret,
+		httpClient:    &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Run refreshes every non-terminal job and returns the number it updated.
+func (r *Reconciler) Run() (int, error) {
+	logger := log.WithFields(log.Fields{"source": "ExportQueryAPI-reconciler"})
+
+	rows, err := r.fetchNonTerminalJobs()
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to fetch non-terminal jobs with error: %v", err.Error()))
+		return 0, err
+	}
+
+	updated := 0
+	for _, row := range rows {
+		jobLogger := logger.WithFields(log.Fields{"id": row.id, "jobId": row.jobId, "requestId": row.requestId})
+
+		if row.jobId == "" {
+			jobLogger.Error("Non-terminal row has no jobId, marking FAILED instead of polling EMR")
+			if err := r.updateJobStatus(row.id, "FAILED"); err != nil {
+				jobLogger.Error(fmt.Sprintf("Failed to update jobstatus with error: %v", err.Error()))
+			}
+			continue
+		}
+
+		output, err := r.service.GetJobRun(&emrserverless.GetJobRunInput{
+			ApplicationId: r.applicationId,
+			JobRunId:      aws.String(row.jobId),
+		})
+		if err != nil {
+			jobLogger.Error(fmt.Sprintf("Failed to GetJobRun with error: %v", err.Error()))
+			continue
+		}
+
+		newStatus := aws.StringValue(output.JobRun.State)
+		if newStatus == row.jobStatus {
+			continue
+		}
+
+		if err := r.updateJobStatus(row.id, newStatus); err != nil {
+			jobLogger.Error(fmt.Sprintf("Failed to update jobstatus with error: %v", err.Error()))
+			continue
+		}
+		row.jobStatus = newStatus
+		row.stateDetails = aws.StringValue(output.JobRun.StateDetails)
+		updated++
+
+		if row.callbackUrl.Valid && row.callbackUrl.String != "" {
+			if err := r.notifyCallback(row); err != nil {
+				jobLogger.Error(fmt.Sprintf("Failed to notify callbackUrl with error: %v", err.Error()))
+			}
+		}
+	}
+
+	return updated, nil
+}
+
+func (r *Reconciler) fetchNonTerminalJobs() ([]*jobRow, error) {
+	statement := `SELECT "id", "jobid", "jobstatus", "requestid", "destination", "callbackurl" FROM "emr_job_details" WHERE "jobstatus" NOT IN ($1, $2, $3)`
+
+	rows, err := r.db.Query(statement, terminalJobStatuses[0], terminalJobStatuses[1], terminalJobStatuses[2])
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []*jobRow
+	for rows.Next() {
+		row := &jobRow{}
+		var requestId, destination sql.NullString
+		if err := rows.Scan(&row.id, &row.jobId, &row.jobStatus, &requestId, &destination, &row.callbackUrl); err != nil {
+			return nil, err
+		}
+		row.requestId = requestId.String
+		row.destination = destination.String
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
+
+func (r *Reconciler) updateJobStatus(id string, jobStatus string) error {
+	statement := `UPDATE "emr_job_details" SET "jobstatus" = $1, "updatedat" = $2 WHERE "id" = $3`
+	_, err := r.db.Exec(statement, jobStatus, time.Now(), id)
+	return err
+}
+
+func (r *Reconciler) notifyCallback(row *jobRow) error {
+	payload := CallbackPayload{
+		Id:            row.id,
+		JobId:         row.jobId,
+		JobStatus:     row.jobStatus,
+		RequestId:     row.requestId,
+		S3Destination: row.destination,
+	}
+	if row.jobStatus == "FAILED" {
+		payload.Error = row.stateDetails
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequest("POST", row.callbackUrl.String, bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Signature", r.sign(body))
+
+	response, err := r.httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("callback endpoint returned status %v", response.StatusCode)
+	}
+	return nil
+}
+
+// sign returns the hex-encoded HMAC-SHA256 of body using the Reconciler's secret.
+func (r *Reconciler) sign(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(r.signingSecret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}